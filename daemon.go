@@ -0,0 +1,192 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultRefreshInterval is how often a feed is refetched in --daemon mode
+// when neither the feed nor daemon.refresh_interval configures one.
+const defaultRefreshInterval = time.Hour
+
+// feedScheduler is the long-lived goroutine that re-dispatches one feed to
+// its worker channel on a fixed cadence. stop lets daemonState.reconcile
+// retire it on a SIGHUP reload without touching the channel it feeds.
+type feedScheduler struct {
+	stop chan struct{}
+}
+
+// daemonState holds everything runDaemon needs to keep fetching feeds on
+// their own schedules across a SIGHUP reload. The item channel and the
+// per-domain/exec worker channels are created once and live for the life of
+// the process; only the schedulers feeding them are replaced on reload, so
+// items already queued on a worker channel are never dropped.
+type daemonState struct {
+	itemChan   chan feedItem
+	execFeedCh chan *FeedSpec
+
+	mu         sync.Mutex
+	domains    map[string]chan *FeedSpec
+	schedulers map[string]*feedScheduler
+}
+
+// refreshIntervalFor resolves a feed's refresh cadence: its own
+// refresh_interval, else daemon.refresh_interval, else
+// defaultRefreshInterval.
+func refreshIntervalFor(fs *FeedSpec) time.Duration {
+	if fs.RefreshInterval != "" {
+		if d, err := time.ParseDuration(fs.RefreshInterval); err == nil {
+			return d
+		}
+		log.Printf("warn: invalid refresh_interval '%s' for feed '%s', falling back to daemon default", fs.RefreshInterval, fs.Name)
+	}
+	if getConfig().Daemon.refreshInterval > 0 {
+		return getConfig().Daemon.refreshInterval
+	}
+	return defaultRefreshInterval
+}
+
+// domainChanFor returns the worker channel for host, starting its
+// processDomainFeeds goroutine the first time a feed on that domain is
+// scheduled. The goroutine runs for the life of the process, same as the
+// exec worker pool.
+func (d *daemonState) domainChanFor(host string) chan *FeedSpec {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.domains[host]
+	if !ok {
+		c = make(chan *FeedSpec, 1000)
+		d.domains[host] = c
+		go processDomainFeeds(c, d.itemChan, func() {})
+	}
+	return c
+}
+
+// dispatch sends fs to whichever worker channel handles it.
+func (d *daemonState) dispatch(fs *FeedSpec) {
+	if len(fs.Exec) > 0 {
+		d.execFeedCh <- fs
+		return
+	}
+	u, err := url.Parse(fs.URL)
+	if err != nil {
+		log.Printf("warn: cannot parse '%s' feed URL '%s': %s", fs.Name, fs.URL, err)
+		return
+	}
+	fs.parsedURL = u
+	d.domainChanFor(u.Host) <- fs
+}
+
+// schedule dispatches fs immediately, then again every refresh interval
+// until its scheduler is stopped.
+func (d *daemonState) schedule(fs *FeedSpec) *feedScheduler {
+	s := &feedScheduler{stop: make(chan struct{})}
+	go func() {
+		d.dispatch(fs)
+		t := time.NewTicker(refreshIntervalFor(fs))
+		defer t.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+				d.dispatch(fs)
+			}
+		}
+	}()
+	return s
+}
+
+// reconcile replaces the running set of per-feed schedulers with one per
+// feed in feeds. The new schedulers are started before the old ones are
+// stopped, and worker/item channels are never closed or recreated, so a
+// reload never drops an item already in flight.
+func (d *daemonState) reconcile(feeds []*FeedSpec) {
+	next := map[string]*feedScheduler{}
+	for _, fs := range feeds {
+		next[fs.Name] = d.schedule(fs)
+	}
+
+	d.mu.Lock()
+	old := d.schedulers
+	d.schedulers = next
+	d.mu.Unlock()
+
+	for _, s := range old {
+		close(s.stop)
+	}
+}
+
+// digestLoop checks digest.schedule once a minute for the life of the
+// daemon, the continuous-mode equivalent of run()'s one-shot
+// deliverDueDigest() call at exit.
+func digestLoop() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for range t.C {
+		if err := deliverDueDigest(); err != nil {
+			log.Printf("warn: failed to deliver digest: %s", err)
+		}
+	}
+}
+
+// runDaemon implements --daemon: instead of fetching every feed once and
+// exiting, it starts the same SMTP/IMAP and exec worker pools as run() but
+// leaves them running, gives each feed its own scheduler goroutine driven by
+// refreshIntervalFor, and blocks reloading the config on SIGHUP until
+// killed.
+func runDaemon() error {
+	cfg := getConfig()
+	itemChan := make(chan feedItem, 1000)
+	if cfg.IMAP.Address != "" {
+		for i := 0; i < cfg.IMAP.Jobs; i++ {
+			go imapDeliver(itemChan, func() {})
+		}
+	} else {
+		for i := 0; i < cfg.SMTP.Jobs; i++ {
+			go sendEmails(itemChan, func() {})
+		}
+	}
+
+	execFeedCh := make(chan *FeedSpec, 1000)
+	for i := 0; i < cfg.Exec.Jobs; i++ {
+		go processExecFeeds(execFeedCh, itemChan, func() {})
+	}
+
+	d := &daemonState{
+		itemChan:   itemChan,
+		execFeedCh: execFeedCh,
+		domains:    map[string]chan *FeedSpec{},
+		schedulers: map[string]*feedScheduler{},
+	}
+	d.reconcile(cfg.Feeds)
+	log.Printf("info: daemon started, watching %d feed(s)", len(cfg.Feeds))
+
+	if cfg.Daemon.MetricsAddress != "" {
+		startMetricsServer(cfg.Daemon.MetricsAddress)
+	}
+	if cfg.Digest.Schedule != "" {
+		go digestLoop()
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		log.Printf("info: sighup received, reloading config from '%s'", *configPath)
+		next := NewConfig()
+		if err := next.LoadFile(*configPath); err != nil {
+			log.Printf("warn: failed to reload config, keeping previous config running: %s", err)
+			continue
+		}
+		setConfig(next)
+		d.reconcile(next.Feeds)
+		log.Printf("info: reloaded config, now watching %d feed(s)", len(next.Feeds))
+	}
+
+	return nil
+}
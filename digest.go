@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// digestFeedGroup is one feed's share of a digest email, as handed to
+// digest.content_tpl/digest.subject_tpl.
+type digestFeedGroup struct {
+	FeedName string
+	Items    []digestItem
+}
+
+// isDigestFeed reports whether fs's items should be buffered for the next
+// digest email instead of emailed immediately.
+func isDigestFeed(fs *FeedSpec) bool {
+	cfg := getConfig()
+	return cfg.Digest.Schedule != "" && (cfg.Digest.Global || fs.Digest)
+}
+
+// enqueueDigestItem renders fi's content with the normal per-item content
+// template and appends it to the persistent digest queue.
+func enqueueDigestItem(fi feedItem) error {
+	var buf bytes.Buffer
+	if err := getConfig().Email.contentTpl.Execute(&buf, fi); err != nil {
+		return fmt.Errorf("failed to render content tpl: %s", err)
+	}
+	return store.addDigestItem(digestItem{
+		FeedName: fi.FeedSpec.Name,
+		Title:    fi.Item.Title,
+		Link:     fi.Item.Link,
+		Content:  buf.String(),
+	})
+}
+
+// groupDigestItems groups a flat list of queued items by feed, preserving
+// the order feeds first appear in.
+func groupDigestItems(items []digestItem) []digestFeedGroup {
+	var groups []digestFeedGroup
+	index := map[string]int{}
+	for _, i := range items {
+		gi, ok := index[i.FeedName]
+		if !ok {
+			gi = len(groups)
+			index[i.FeedName] = gi
+			groups = append(groups, digestFeedGroup{FeedName: i.FeedName})
+		}
+		groups[gi].Items = append(groups[gi].Items, i)
+	}
+	return groups
+}
+
+// deliverDueDigest sends the pending digest queue as a single email if
+// digest.schedule matches the current time and hasn't already fired this
+// minute, then clears the queue. The queue is only cleared once delivery
+// has actually succeeded, so a render/send failure leaves the items queued
+// for the next attempt instead of losing them.
+func deliverDueDigest() error {
+	due, err := digestDue()
+	if err != nil || !due {
+		return err
+	}
+
+	items := store.pendingDigestItems()
+	if len(items) == 0 {
+		log.Printf("info: digest window reached but no items are queued")
+		return store.setLastDigestSent(time.Now())
+	}
+
+	groups := groupDigestItems(items)
+	sender, msg, err := renderDigestMessage(groups)
+	if err != nil {
+		return err
+	}
+
+	if getConfig().IMAP.Address != "" {
+		fi := feedItem{FeedSpec: &FeedSpec{Name: "Digest"}, Config: getConfig()}
+		folder, err := imapFolder(fi)
+		if err != nil {
+			return err
+		}
+		if err := imapAppend(folder, msg); err != nil {
+			return fmt.Errorf("failed to deliver digest via imap: %s", err)
+		}
+	} else {
+		if err := sendEmail(sender, msg); err != nil {
+			return fmt.Errorf("failed to send digest email: %s", err)
+		}
+	}
+	log.Printf("info: sent digest email covering %d item(s) across %d feed(s)", len(items), len(groups))
+
+	if err := store.drainDigest(); err != nil {
+		return fmt.Errorf("failed to drain digest queue: %s", err)
+	}
+	return store.setLastDigestSent(time.Now())
+}
+
+// renderDigestMessage renders digest.subject_tpl/digest.content_tpl against
+// groups and assembles the RFC822 message.
+func renderDigestMessage(groups []digestFeedGroup) (sender, msg string, err error) {
+	var buf bytes.Buffer
+	cfg := getConfig()
+
+	digestFI := feedItem{FeedSpec: &FeedSpec{Name: "Digest"}, Config: cfg}
+	if err = cfg.SMTP.senderTpl.Execute(&buf, digestFI); err != nil {
+		return "", "", fmt.Errorf("failed to render sender tpl: %s", err)
+	}
+	sender = buf.String()
+	buf.Reset()
+
+	if err = cfg.Digest.subjectTpl.Execute(&buf, groups); err != nil {
+		return "", "", fmt.Errorf("failed to render digest subject tpl: %s", err)
+	}
+	subject := buf.String()
+	buf.Reset()
+
+	if err = cfg.Digest.contentTpl.Execute(&buf, groups); err != nil {
+		return "", "", fmt.Errorf("failed to render digest content tpl: %s", err)
+	}
+	content := buf.String()
+
+	to := cfg.SMTP.Recipient
+	if cfg.IMAP.Address != "" {
+		to = cfg.IMAP.Username
+	}
+	msg = fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/html;charset=utf8\r\n\r\n%s",
+		sender, to, subject, content,
+	)
+	return sender, msg, nil
+}
+
+// digestDue reports whether digest.schedule matches the current minute and
+// a digest hasn't already been sent this minute.
+func digestDue() (bool, error) {
+	now := time.Now()
+	fields, err := cronFields(getConfig().Digest.Schedule)
+	if err != nil {
+		return false, err
+	}
+	if !fields.matches(now) {
+		return false, nil
+	}
+	return now.Truncate(time.Minute).After(store.lastDigestSentAt()), nil
+}
+
+// cronSchedule is a minimal 5-field (minute hour day-of-month month
+// day-of-week) cron schedule supporting "*", "*/N" and comma-separated
+// lists - enough for the "every N hours" / "at HH:MM daily" schedules
+// digest mode is meant for, not the full cron grammar.
+type cronSchedule struct {
+	minute, hour, dom, month, dow string
+}
+
+func cronFields(spec string) (cronSchedule, error) {
+	f := strings.Fields(spec)
+	if len(f) != 5 {
+		return cronSchedule{}, fmt.Errorf("schedule must have 5 fields (minute hour dom month dow), got '%s'", spec)
+	}
+	return cronSchedule{minute: f[0], hour: f[1], dom: f[2], month: f[3], dow: f[4]}, nil
+}
+
+func (c cronSchedule) matches(t time.Time) bool {
+	return cronFieldMatches(c.minute, t.Minute()) &&
+		cronFieldMatches(c.hour, t.Hour()) &&
+		cronFieldMatches(c.dom, t.Day()) &&
+		cronFieldMatches(c.month, int(t.Month())) &&
+		cronFieldMatches(c.dow, int(t.Weekday()))
+}
+
+func cronFieldMatches(field string, value int) bool {
+	if field == "*" {
+		return true
+	}
+	for _, part := range strings.Split(field, ",") {
+		if strings.HasPrefix(part, "*/") {
+			if n, err := strconv.Atoi(part[2:]); err == nil && n > 0 && value%n == 0 {
+				return true
+			}
+			continue
+		}
+		if n, err := strconv.Atoi(part); err == nil && n == value {
+			return true
+		}
+	}
+	return false
+}
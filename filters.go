@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/robertkrimen/otto"
+)
+
+// FilterRule is one entry in a FeedSpec's `filters:` list. Match is a JS
+// expression evaluated against `item`/`feed` objects (see newFilterVM); if
+// it evaluates truthy, Action decides what happens to the item: "drop"
+// discards it, "mark_read" stores it as seen without emailing it, "rewrite"
+// applies whatever the script mutated on `item` back onto the real feed
+// item, and "tag" adds an X-Frider-Tag header carrying Tag (or whatever the
+// script set item.tag to).
+type FilterRule struct {
+	Match  string `yaml:"match"`
+	Action string `yaml:"action"`
+	Tag    string `yaml:"tag,omitempty"`
+
+	program *otto.Script
+}
+
+// compile parses r.Match once at config load time so evaluating it per-item
+// doesn't re-parse the script on every run.
+func (r *FilterRule) compile() error {
+	vm := otto.New()
+	program, err := vm.Compile("filter", r.Match)
+	if err != nil {
+		return fmt.Errorf("can't parse filter match expression '%s': %s", r.Match, err)
+	}
+	r.program = program
+	return nil
+}
+
+type filterResult struct {
+	Action string
+	Tag    string
+}
+
+// newFilterVM builds an otto VM with `item`/`feed` bound to fi/f and a small
+// helper library (regex, url, time) exposed for filters to use in their
+// match expressions.
+func newFilterVM(f *gofeed.Feed, fi *feedItem) *otto.Otto {
+	vm := otto.New()
+
+	vm.Set("regexTest", func(pattern, s string) bool {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false
+		}
+		return re.MatchString(s)
+	})
+	vm.Set("regexMatch", func(pattern, s string) []string {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil
+		}
+		return re.FindStringSubmatch(s)
+	})
+	vm.Set("urlParse", func(s string) map[string]string {
+		u, err := url.Parse(s)
+		if err != nil {
+			return map[string]string{}
+		}
+		return map[string]string{"scheme": u.Scheme, "host": u.Host, "path": u.Path, "query": u.RawQuery}
+	})
+	vm.Set("timeParse", func(layout, s string) int64 {
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			return 0
+		}
+		return t.Unix()
+	})
+
+	vm.Set("item", map[string]interface{}{
+		"title":       fi.Item.Title,
+		"link":        fi.Item.Link,
+		"guid":        fi.Item.GUID,
+		"content":     fi.Item.Content,
+		"description": fi.Item.Description,
+		"categories":  fi.Item.Categories,
+		"tag":         "",
+	})
+	vm.Set("feed", map[string]interface{}{
+		"title": f.Title,
+		"link":  f.Link,
+	})
+
+	return vm
+}
+
+// runFilters evaluates fs's filter rules in order against fi and returns the
+// first matching rule's decision. If no rule matches, the zero filterResult
+// is returned and the item is delivered normally.
+func runFilters(fs *FeedSpec, f *gofeed.Feed, fi *feedItem) (filterResult, error) {
+	for _, r := range fs.Filters {
+		vm := newFilterVM(f, fi)
+		v, err := vm.Run(r.program)
+		if err != nil {
+			return filterResult{}, fmt.Errorf("filter match expression '%s' failed: %s", r.Match, err)
+		}
+		matched, err := v.ToBoolean()
+		if err != nil || !matched {
+			continue
+		}
+
+		res := filterResult{Action: r.Action, Tag: r.Tag}
+
+		if r.Action == "rewrite" {
+			applyRewrite(fi, vm)
+		}
+		if r.Action == "tag" {
+			if itemVal, err := vm.Get("item"); err == nil {
+				if exported, err := itemVal.Export(); err == nil {
+					if m, ok := exported.(map[string]interface{}); ok {
+						if tag, ok := m["tag"].(string); ok && tag != "" {
+							res.Tag = tag
+						}
+					}
+				}
+			}
+		}
+		return res, nil
+	}
+	return filterResult{}, nil
+}
+
+// applyRewrite copies whatever the filter script mutated on the JS `item`
+// object back onto the real feed item.
+func applyRewrite(fi *feedItem, vm *otto.Otto) {
+	itemVal, err := vm.Get("item")
+	if err != nil {
+		return
+	}
+	exported, err := itemVal.Export()
+	if err != nil {
+		return
+	}
+	m, ok := exported.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if title, ok := m["title"].(string); ok {
+		fi.Item.Title = title
+	}
+	if link, ok := m["link"].(string); ok {
+		fi.Item.Link = link
+	}
+	if content, ok := m["content"].(string); ok {
+		fi.Item.Content = content
+	}
+	if description, ok := m["description"].(string); ok {
+		fi.Item.Description = description
+	}
+}
+
+// runTestFilters implements --test-filters: it reads each configured feed
+// once (without touching storage or sending any email) and prints the
+// action each item's filters decide on, to help authors debug match
+// expressions.
+func runTestFilters() error {
+	parser := gofeed.NewParser()
+	parser.UserAgent = useragent
+	cfg := getConfig()
+
+	for _, fs := range cfg.Feeds {
+		var f *gofeed.Feed
+		var err error
+
+		if len(fs.Exec) > 0 {
+			var b []byte
+			b, err = exec.Command(fs.Exec[0], fs.Exec[1:]...).Output()
+			if err == nil {
+				f, err = parser.Parse(bytes.NewReader(b))
+			}
+		} else {
+			f, err = parser.ParseURL(fs.URL)
+		}
+		if err != nil {
+			log.Printf("warn: failed to read feed '%s': %s", fs.Name, err)
+			continue
+		}
+
+		for _, i := range f.Items {
+			fi := feedItem{Feed: f, Item: &richItem{Item: i}, FeedSpec: fs, Config: cfg}
+			action := "deliver"
+			if len(fs.Filters) > 0 {
+				res, err := runFilters(fs, f, &fi)
+				if err != nil {
+					log.Printf("warn: %s", err)
+				} else if res.Action != "" {
+					action = res.Action
+				}
+			}
+			fmt.Printf("%s\t%s\t%s\n", fs.Name, action, i.Title)
+		}
+	}
+	return nil
+}
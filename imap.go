@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// imapFolder renders the mailbox folder an item should be delivered into,
+// using the imap.folder template (defaults to one folder per feed name).
+func imapFolder(fi feedItem) (string, error) {
+	var buf bytes.Buffer
+	if err := getConfig().IMAP.folderTpl.Execute(&buf, fi); err != nil {
+		return "", fmt.Errorf("failed to render imap.folder tpl: %s", err)
+	}
+	return buf.String(), nil
+}
+
+// imapAppend dials the IMAP server, ensures folder exists and APPENDs msg to
+// it as an unseen message. Like sendEmail, it opens a fresh connection per
+// message rather than pooling one - this matches the simplicity of the SMTP
+// path and avoids needing to manage a shared, possibly-stale connection
+// across worker goroutines.
+func imapAppend(folder, msg string) error {
+	cfg := getConfig()
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.IMAP.SkipTLSVerify,
+		ServerName:         cfg.IMAP.host,
+	}
+	c, err := client.DialTLS(cfg.IMAP.Address, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("failed to dial imap server: %s", err)
+	}
+	defer c.Logout()
+
+	if err := c.Login(cfg.IMAP.Username, cfg.IMAP.Password); err != nil {
+		return fmt.Errorf("failed to login to imap server: %s", err)
+	}
+
+	if err := ensureIMAPFolder(c, folder); err != nil {
+		return err
+	}
+
+	lit := bytes.NewBufferString(msg)
+	if err := c.Append(folder, nil, time.Now(), lit); err != nil {
+		return fmt.Errorf("failed to append to folder '%s': %s", folder, err)
+	}
+	return nil
+}
+
+// ensureIMAPFolder creates folder if it doesn't already exist.
+func ensureIMAPFolder(c *client.Client, folder string) error {
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", folder, mailboxes)
+	}()
+	found := false
+	for m := range mailboxes {
+		if m.Name == folder {
+			found = true
+		}
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("failed to list imap folder '%s': %s", folder, err)
+	}
+	if found {
+		return nil
+	}
+	if err := c.Create(folder); err != nil {
+		return fmt.Errorf("failed to create imap folder '%s': %s", folder, err)
+	}
+	return nil
+}
+
+// imapDeliver is the IMAP analogue of sendEmails: it renders each feedItem
+// into an RFC822 message and APPENDs it into its feed's folder instead of
+// sending it over SMTP.
+func imapDeliver(c chan feedItem, done func()) {
+	defer done()
+
+	for fi := range c {
+		uid, _ := calcItemUID(fi) // processDomainFeeds ensures we don't get errors here
+
+		folder, err := imapFolder(fi)
+		if err != nil {
+			log.Printf("warn: %s", err)
+			continue
+		}
+
+		sender, msg, err := renderMessage(fi, getConfig().IMAP.Username)
+		if err != nil {
+			log.Printf("warn: %s", err)
+			continue
+		}
+
+		if err := imapAppend(folder, msg); err != nil {
+			log.Printf("warn: failed to deliver '%s' via imap: %s", sender, err)
+			continue
+		}
+		log.Printf("info: delivered feed item to imap folder '%s': %s - %s", folder, fi.FeedSpec.Name, fi.Item.Title)
+		recordEmailSent(fi.FeedSpec.Name)
+
+		if err := store.setItemHash(fi.feedUID, uid, fi.itemHash); err != nil {
+			log.Printf("warn: failed to record item '%s' in storage: %s", uid, err)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
 	"crypto/tls"
 	"errors"
 	"flag"
@@ -20,6 +19,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"sync"
+	"sync/atomic"
 	ttemplate "text/template"
 	"time"
 
@@ -52,6 +52,17 @@ type Config struct {
 		Password  string `yaml:"password"`
 		Jobs      int    `yaml:"jobs"`
 	} `yaml:"smtp"`
+	IMAP struct {
+		Address       string `yaml:"address"`
+		host          string
+		port          string
+		Username      string `yaml:"username"`
+		Password      string `yaml:"password"`
+		SkipTLSVerify bool   `yaml:"skip_tls_verify"`
+		Folder        string `yaml:"folder"`
+		folderTpl     *ttemplate.Template
+		Jobs          int `yaml:"jobs"`
+	} `yaml:"imap"`
 	Email struct {
 		Subject    string `yaml:"subject"`
 		subjectTpl *ttemplate.Template
@@ -62,6 +73,33 @@ type Config struct {
 	Exec  struct {
 		Jobs int `yaml:"jobs"`
 	} `yaml:"exec"`
+	Digest struct {
+		Schedule   string `yaml:"schedule"`
+		Global     bool   `yaml:"global"`
+		SubjectTpl string `yaml:"subject_tpl"`
+		subjectTpl *ttemplate.Template
+		ContentTpl string `yaml:"content_tpl"`
+		contentTpl *htemplate.Template
+	} `yaml:"digest"`
+	Daemon struct {
+		RefreshInterval string `yaml:"refresh_interval"`
+		refreshInterval time.Duration
+		MetricsAddress  string `yaml:"metrics_address"`
+	} `yaml:"daemon"`
+}
+
+// getConfig returns the currently active config. It's safe to call
+// concurrently with setConfig, so --daemon's SIGHUP reload can swap the
+// config out from under the long-lived worker goroutines without racing
+// their reads of it.
+func getConfig() *Config {
+	return configVal.Load().(*Config)
+}
+
+// setConfig publishes c as the config every subsequent getConfig() call
+// returns.
+func setConfig(c *Config) {
+	configVal.Store(c)
 }
 
 func NewConfig() *Config {
@@ -70,16 +108,26 @@ func NewConfig() *Config {
 	c.Storage.ItemUID = feedLinkTpl + "|{{or .Item.GUID .Item.Link}}"
 	c.Storage.FeedUID = feedLinkTpl
 	c.SMTP.Jobs = 4
+	c.IMAP.Folder = "INBOX/Feeds/{{.FeedSpec.Name}}"
+	c.IMAP.Jobs = 4
 	c.Exec.Jobs = 4
 	c.Email.Subject = "{{.Item.Title | nonewlines}}"
 	c.Email.Content = `<h2><a href="{{.Item.Link}}">{{.Item.Title}}</a></h2>
-{{with $c := (or .Item.Content .Item.Description)}}
+{{with $c := (or .Item.FullContent .Item.Content .Item.Description)}}
   {{if (ishtml $c)}}
     {{$c | noescape}}
   {{else}}
     <p style="white-space:pre-wrap">{{$c}}</p>
   {{end}}
 {{end}}
+`
+	c.Digest.SubjectTpl = `Digest: {{len .}} feed(s) updated`
+	c.Digest.ContentTpl = `{{range .}}
+<h2>{{.FeedName}}</h2>
+<ul>
+{{range .Items}}  <li><a href="{{.Link}}">{{.Title}}</a></li>
+{{end}}</ul>
+{{end}}
 `
 	return &c
 }
@@ -122,6 +170,49 @@ func (c *Config) Load(r io.Reader) error {
 		c.SMTP.Password = os.Getenv("FRIDER_SMTP_PASSWORD")
 	}
 
+	if c.IMAP.Address != "" {
+		c.IMAP.folderTpl, err = ttemplate.New("").Funcs(tplFuncs).Parse(c.IMAP.Folder)
+		if err != nil {
+			return fmt.Errorf("can't parse imap.folder '%s': %s", c.IMAP.Folder, err)
+		}
+		c.IMAP.host, c.IMAP.port, err = net.SplitHostPort(c.IMAP.Address)
+		if err != nil {
+			return fmt.Errorf("can't parse imap.address '%s': %s", c.IMAP.Address, err)
+		}
+		if c.IMAP.Password == "" {
+			c.IMAP.Password = os.Getenv("FRIDER_IMAP_PASSWORD")
+		}
+	}
+
+	for _, fs := range c.Feeds {
+		for _, r := range fs.Filters {
+			if err := r.compile(); err != nil {
+				return fmt.Errorf("can't compile filter for feed '%s': %s", fs.Name, err)
+			}
+		}
+	}
+
+	if c.Daemon.RefreshInterval != "" {
+		c.Daemon.refreshInterval, err = time.ParseDuration(c.Daemon.RefreshInterval)
+		if err != nil {
+			return fmt.Errorf("can't parse daemon.refresh_interval '%s': %s", c.Daemon.RefreshInterval, err)
+		}
+	}
+
+	if c.Digest.Schedule != "" {
+		if _, err := cronFields(c.Digest.Schedule); err != nil {
+			return fmt.Errorf("can't parse digest.schedule '%s': %s", c.Digest.Schedule, err)
+		}
+		c.Digest.subjectTpl, err = ttemplate.New("").Funcs(tplFuncs).Parse(c.Digest.SubjectTpl)
+		if err != nil {
+			return fmt.Errorf("can't parse digest.subject_tpl '%s': %s", c.Digest.SubjectTpl, err)
+		}
+		c.Digest.contentTpl, err = htemplate.New("").Funcs(tplFuncs).Parse(c.Digest.ContentTpl)
+		if err != nil {
+			return fmt.Errorf("can't parse digest.content_tpl '%s': %s", c.Digest.ContentTpl, err)
+		}
+	}
+
 	return nil
 }
 
@@ -149,20 +240,51 @@ type FeedSpec struct {
 	URL           string   `yaml:"url"`
 	SkipTLSVerify bool     `yaml:"skip_tls_verify"`
 	Exec          []string `yaml:"exec"`
-	parsedURL     *url.URL
+	EmbedImages   bool     `yaml:"embed_images"`
+	MaxImageSize  int64    `yaml:"max_image_size"`
+
+	FetchFullContent bool     `yaml:"fetch_full_content"`
+	MaxContentSize   int64    `yaml:"max_content_size"`
+	ContentSelector  string   `yaml:"content_selector"`
+	StripSelectors   []string `yaml:"strip_selectors"`
+
+	Filters []*FilterRule `yaml:"filters"`
+
+	Digest bool `yaml:"digest"`
+
+	// RefreshInterval overrides daemon.refresh_interval for this feed in
+	// --daemon mode (e.g. "15m"). Ignored outside --daemon mode, where
+	// every feed is fetched once per run.
+	RefreshInterval string `yaml:"refresh_interval"`
+
+	parsedURL *url.URL
+}
+
+// richItem wraps a parsed feed item with data derived after parsing (e.g.
+// the full-content extraction), so templates can keep addressing it as
+// `.Item.*` via Go's promoted-field rules.
+type richItem struct {
+	*gofeed.Item
+	FullContent string
 }
 
 type feedItem struct {
 	Feed     *gofeed.Feed
-	Item     *gofeed.Item
+	Item     *richItem
 	FeedSpec *FeedSpec
 	Config   *Config
+
+	feedUID  string
+	itemHash string
+	tag      string
 }
 
 var (
 	configPath         = flag.String("config", os.Getenv("FRIDER_CONFIG"), "path to config file")
 	printDefaultConfig = flag.Bool("print-default-config", false, "print default config and exit")
-	config             *Config
+	testFilters        = flag.Bool("test-filters", false, "read each feed once and print the filter action decided for every item, without sending any email")
+	daemonMode         = flag.Bool("daemon", false, "run continuously, fetching each feed on its own refresh_interval instead of once, until killed")
+	configVal          atomic.Value // holds *Config
 	store              *storage
 
 	newlinePat = regexp.MustCompile(`[\r\n]+`)
@@ -181,46 +303,6 @@ var (
 	}
 )
 
-type storage struct {
-	path string
-}
-
-func (s *storage) keyPath(k string) string {
-	h := fmt.Sprintf("%x", sha256.Sum256([]byte(k)))
-	return filepath.Join(s.path, h[:2], h)
-}
-
-func (s *storage) has(k string) bool {
-	kp := s.keyPath(k)
-	_, err := os.Stat(kp)
-	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			log.Printf("warn: cannot stat key '%s' in storage: %s", kp, err)
-		}
-		return false
-	}
-	return true
-}
-
-func (s *storage) set(k string) {
-	kp := s.keyPath(k)
-	d := filepath.Dir(kp)
-	if err := os.MkdirAll(d, os.ModePerm); err != nil {
-		log.Printf("warn: cannot create dir '%s' in storage: %s", d, err)
-		return
-	}
-	f, err := os.Create(kp)
-	if err != nil {
-		log.Printf("cannot create key '%s' in storage: %s", kp, err)
-		return
-	}
-	defer f.Close()
-	if _, err := f.Write([]byte(k)); err != nil {
-		log.Printf("cannot write content of key '%s' in storage: %s", kp, err)
-		return
-	}
-}
-
 func extractEmail(addr string) string {
 	m := emailPat.FindStringSubmatch(addr)
 	if m == nil {
@@ -230,12 +312,13 @@ func extractEmail(addr string) string {
 }
 
 func sendEmail(from, msg string) error {
-	auth := smtp.PlainAuth("", config.SMTP.Username, config.SMTP.Password, config.SMTP.host)
+	cfg := getConfig()
+	auth := smtp.PlainAuth("", cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.host)
 	tlsconfig := &tls.Config{
 		InsecureSkipVerify: true,
-		ServerName:         config.SMTP.host,
+		ServerName:         cfg.SMTP.host,
 	}
-	c, err := smtp.Dial(config.SMTP.Address)
+	c, err := smtp.Dial(cfg.SMTP.Address)
 	if err != nil {
 		return err
 	}
@@ -246,7 +329,7 @@ func sendEmail(from, msg string) error {
 	if err = c.Mail(extractEmail(from)); err != nil {
 		return err
 	}
-	if err = c.Rcpt(extractEmail(config.SMTP.Recipient)); err != nil {
+	if err = c.Rcpt(extractEmail(cfg.SMTP.Recipient)); err != nil {
 		return err
 	}
 	w, err := c.Data()
@@ -265,52 +348,77 @@ func sendEmail(from, msg string) error {
 	return nil
 }
 
-func sendEmails(c chan feedItem, done func()) {
-	defer done()
+// renderMessage executes the sender/subject/content templates for fi and
+// assembles them into an RFC822 message addressed to "to".
+func renderMessage(fi feedItem, to string) (sender, msg string, err error) {
 	var buf bytes.Buffer
+	cfg := getConfig()
 
-	for fi := range c {
-		uid, _ := calcItemUID(fi) // processDomainFeeds ensures we don't get errors here
+	if err = cfg.SMTP.senderTpl.Execute(&buf, fi); err != nil {
+		return "", "", fmt.Errorf("failed to render sender tpl: %s", err)
+	}
+	sender = buf.String()
+	buf.Reset()
 
-		if err := config.SMTP.senderTpl.Execute(&buf, fi); err != nil {
-			log.Printf("warn: failed to render sender tpl: %s", err)
-			continue
-		}
-		sender := string(buf.Bytes())
-		buf.Reset()
+	if err = cfg.Email.subjectTpl.Execute(&buf, fi); err != nil {
+		return "", "", fmt.Errorf("failed to render subject tpl: %s", err)
+	}
+	subject := buf.String()
+	buf.Reset()
 
-		if err := config.Email.subjectTpl.Execute(&buf, fi); err != nil {
-			log.Printf("warn: failed to render subject tpl: %s", err)
-			continue
+	if err = cfg.Email.contentTpl.Execute(&buf, fi); err != nil {
+		return "", "", fmt.Errorf("failed to render content tpl: %s", err)
+	}
+	content := buf.String()
+
+	tagHeader := ""
+	if fi.tag != "" {
+		tagHeader = fmt.Sprintf("X-Frider-Tag: %s\r\n", newlinePat.ReplaceAllString(fi.tag, " "))
+	}
+
+	if fi.FeedSpec.EmbedImages || len(fi.Item.Enclosures) > 0 {
+		msg, err = buildRichMessage(fi, sender, to, subject, content, tagHeader)
+		if err != nil {
+			return "", "", err
 		}
-		subject := string(buf.Bytes())
-		buf.Reset()
+		return sender, msg, nil
+	}
+
+	msg = fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\n%sContent-Type: text/html;charset=utf8\r\n\r\n%s",
+		sender, to, subject, tagHeader, content,
+	)
+	return sender, msg, nil
+}
+
+func sendEmails(c chan feedItem, done func()) {
+	defer done()
+
+	for fi := range c {
+		uid, _ := calcItemUID(fi) // processDomainFeeds ensures we don't get errors here
 
-		if err := config.Email.contentTpl.Execute(&buf, fi); err != nil {
-			log.Printf("warn: failed to render content tpl: %s", err)
+		sender, msg, err := renderMessage(fi, getConfig().SMTP.Recipient)
+		if err != nil {
+			log.Printf("warn: %s", err)
 			continue
 		}
-		content := string(buf.Bytes())
-		buf.Reset()
-
-		msg := fmt.Sprintf(
-			"From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/html;charset=utf8\r\n\r\n%s",
-			sender, config.SMTP.Recipient, subject, content,
-		)
 
 		if err := sendEmail(sender, msg); err != nil {
 			log.Printf("warn: failed to send email: %s", err)
 			continue
 		}
 		log.Printf("info: sent feed email: %s - %s", fi.FeedSpec.Name, fi.Item.Title)
+		recordEmailSent(fi.FeedSpec.Name)
 
-		store.set(uid)
+		if err := store.setItemHash(fi.feedUID, uid, fi.itemHash); err != nil {
+			log.Printf("warn: failed to record item '%s' in storage: %s", uid, err)
+		}
 	}
 }
 
 func calcItemUID(i feedItem) (string, error) {
 	var buf bytes.Buffer
-	if err := config.Storage.itemUIDTpl.Execute(&buf, i); err != nil {
+	if err := getConfig().Storage.itemUIDTpl.Execute(&buf, i); err != nil {
 		return "", fmt.Errorf("cannot calculate item UID")
 	}
 	return string(buf.Bytes()), nil
@@ -318,32 +426,109 @@ func calcItemUID(i feedItem) (string, error) {
 
 func calcFeedUID(i feedItem) (string, error) {
 	var buf bytes.Buffer
-	if err := config.Storage.feedUIDTpl.Execute(&buf, i); err != nil {
+	if err := getConfig().Storage.feedUIDTpl.Execute(&buf, i); err != nil {
 		return "", fmt.Errorf("cannot calculate feed UID")
 	}
 	return string(buf.Bytes()), nil
 }
 
+// fetchUID identifies a URL feed's HTTP-level cache state (caching headers
+// and failure backoff) before it's been fetched, so processDomainFeeds can
+// skip it without having parsed it yet. The feed UID template can reference
+// fields (like Feed.FeedLink) that are only known once the feed has been
+// parsed, so fetchUID can't evaluate it directly. Instead it looks up the
+// feed UID processFeeds last computed for this URL, falling back to the URL
+// itself before the feed has ever been parsed. This keeps the pre-parse
+// fetch state and the post-parse item state under the same storage key
+// instead of silently splitting a feed's state across two index entries.
+func fetchUID(fs *FeedSpec) (string, error) {
+	return store.feedUIDForURL(fs.URL), nil
+}
+
 func processDomainFeeds(feedChan chan *FeedSpec, itemChan chan feedItem, done func()) {
 	defer done()
 	for fs := range feedChan {
 		time.Sleep(sameDomainRequestDelay)
+
+		fuid, err := fetchUID(fs)
+		if err != nil {
+			log.Printf("warn: failed to calculate fetch uid for feed '%s': %s", fs.Name, err)
+			continue
+		}
+		if !store.dueForFetch(fuid) {
+			log.Printf("info: skipping url feed '%s': backoff not yet elapsed", fs.Name)
+			continue
+		}
 		log.Printf("info: processing url feed: %s", fs.Name)
 
-		parser := gofeed.NewParser()
-		parser.UserAgent = useragent
 		tr := &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: fs.SkipTLSVerify},
 		}
-		parser.Client = &http.Client{Transport: tr}
+		client := &http.Client{Transport: tr}
 
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		f, err := parser.ParseURLWithContext(fs.URL, ctx)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fs.URL, nil)
+		if err != nil {
+			cancel()
+			log.Printf("warn: failed to build request for feed '%s' url '%s': %s", fs.Name, fs.URL, err)
+			recordFetch(fs.Name, false)
+			if err := store.recordFailure(fuid); err != nil {
+				log.Printf("warn: failed to record failure for feed '%s': %s", fs.Name, err)
+			}
+			continue
+		}
+		req.Header.Set("User-Agent", useragent)
+		etag, lastModified := store.cachingHeaders(fuid)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+
+		resp, err := client.Do(req)
 		cancel()
+		if err != nil {
+			log.Printf("warn: failed to fetch feed '%s' url '%s': %s", fs.Name, fs.URL, err)
+			recordFetch(fs.Name, false)
+			if err := store.recordFailure(fuid); err != nil {
+				log.Printf("warn: failed to record failure for feed '%s': %s", fs.Name, err)
+			}
+			continue
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotModified {
+			log.Printf("info: feed '%s' unchanged since last fetch", fs.Name)
+			recordFetch(fs.Name, true)
+			if err := store.recordSuccess(fuid, etag, lastModified); err != nil {
+				log.Printf("warn: failed to record fetch of feed '%s': %s", fs.Name, err)
+			}
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			log.Printf("warn: failed to fetch feed '%s' url '%s': status %s", fs.Name, fs.URL, resp.Status)
+			recordFetch(fs.Name, false)
+			if err := store.recordFailure(fuid); err != nil {
+				log.Printf("warn: failed to record failure for feed '%s': %s", fs.Name, err)
+			}
+			continue
+		}
+
+		parser := gofeed.NewParser()
+		f, err := parser.Parse(resp.Body)
 		if err != nil {
 			log.Printf("warn: failed to parse feed '%s' url '%s': %s", fs.Name, fs.URL, err)
+			recordFetch(fs.Name, false)
+			if err := store.recordFailure(fuid); err != nil {
+				log.Printf("warn: failed to record failure for feed '%s': %s", fs.Name, err)
+			}
 			continue
 		}
+		recordFetch(fs.Name, true)
+		if err := store.recordSuccess(fuid, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")); err != nil {
+			log.Printf("warn: failed to record fetch of feed '%s': %s", fs.Name, err)
+		}
 
 		if err := processFeeds(fs, f, itemChan); err != nil {
 			log.Printf("warn: %s", err)
@@ -351,31 +536,92 @@ func processDomainFeeds(feedChan chan *FeedSpec, itemChan chan feedItem, done fu
 	}
 }
 
+// itemContentHash returns a hash of the parts of an item that matter to the
+// reader, used to detect when a previously-seen item has been edited.
+func itemContentHash(i *gofeed.Item) string {
+	content := i.Content
+	if content == "" {
+		content = i.Description
+	}
+	return hashContent(i.Title + "\x00" + content)
+}
+
 func processFeeds(fs *FeedSpec, f *gofeed.Feed, itemChan chan feedItem) error {
-	feedUID, err := calcFeedUID(feedItem{Feed: f, FeedSpec: fs, Config: config})
+	cfg := getConfig()
+	feedUID, err := calcFeedUID(feedItem{Feed: f, FeedSpec: fs, Config: cfg})
 	if err != nil {
 		return fmt.Errorf("failed to calculate feed uid in feed '%s': %s", fs.Name, err)
 	}
-	seenFeed := store.has(feedUID)
+	if err := store.setFeedUIDForURL(fs.URL, feedUID); err != nil {
+		log.Printf("warn: failed to record feed uid for '%s': %s", fs.Name, err)
+	}
+	seenFeed := store.feedSeen(feedUID)
 
 	for _, i := range f.Items {
-		fi := feedItem{Feed: f, Item: i, FeedSpec: fs, Config: config}
+		fi := feedItem{Feed: f, Item: &richItem{Item: i}, FeedSpec: fs, Config: cfg}
 		itemUID, err := calcItemUID(fi)
 		if err != nil {
 			log.Printf("warn: failed to calculate item uid in feed '%s': %s", fs.Name, err)
 			continue
 		}
+
+		action := ""
+		if len(fs.Filters) > 0 {
+			res, err := runFilters(fs, f, &fi)
+			if err != nil {
+				log.Printf("warn: failed to evaluate filters for '%s' in feed '%s': %s", i.Title, fs.Name, err)
+			} else {
+				action = res.Action
+				fi.tag = res.Tag
+			}
+		}
+		if action == "drop" {
+			continue
+		}
+
+		hash := itemContentHash(i)
+		prevHash, seenItem := store.itemHash(feedUID, itemUID)
+
 		if seenFeed {
-			if store.has(itemUID) {
+			if seenItem && prevHash == hash {
+				continue
+			}
+			if seenItem {
+				log.Printf("info: item updated since last seen: %s - %s", fs.Name, i.Title)
+			}
+			if action == "mark_read" {
+				if err := store.setItemHash(feedUID, itemUID, hash); err != nil {
+					log.Printf("warn: failed to record item '%s' in storage: %s", itemUID, err)
+				}
+				continue
+			}
+			if fs.FetchFullContent {
+				fetchFullContent(fi)
+			}
+			fi.feedUID = feedUID
+			fi.itemHash = hash
+
+			if isDigestFeed(fs) {
+				if err := enqueueDigestItem(fi); err != nil {
+					log.Printf("warn: failed to queue digest item '%s': %s", i.Title, err)
+					continue
+				}
+				if err := store.setItemHash(feedUID, itemUID, hash); err != nil {
+					log.Printf("warn: failed to record item '%s' in storage: %s", itemUID, err)
+				}
 				continue
 			}
 			itemChan <- fi
-		} else {
-			store.set(itemUID)
+		} else if err := store.setItemHash(feedUID, itemUID, hash); err != nil {
+			log.Printf("warn: failed to record item '%s' in storage: %s", itemUID, err)
 		}
 	}
 
-	store.set(feedUID)
+	if !seenFeed {
+		if err := store.markFeedSeen(feedUID); err != nil {
+			return fmt.Errorf("failed to mark feed '%s' as seen: %s", fs.Name, err)
+		}
+	}
 	return nil
 }
 
@@ -395,6 +641,7 @@ func processExecFeeds(feedChan chan *FeedSpec, itemChan chan feedItem, done func
 				errStr = err.Error()
 			}
 			log.Printf("warn: failed to run exec feed '%s' successfully: %s", fs.Name, errStr)
+			recordFetch(fs.Name, false)
 			continue
 		}
 
@@ -402,8 +649,10 @@ func processExecFeeds(feedChan chan *FeedSpec, itemChan chan feedItem, done func
 		f, err := parser.Parse(r)
 		if err != nil {
 			log.Printf("warn: failed to parse exec feed '%s': %s", fs.Name, err)
+			recordFetch(fs.Name, false)
 			continue
 		}
+		recordFetch(fs.Name, true)
 
 		if err := processFeeds(fs, f, itemChan); err != nil {
 			log.Printf("warn: %s", err)
@@ -413,35 +662,54 @@ func processExecFeeds(feedChan chan *FeedSpec, itemChan chan feedItem, done func
 
 func run() error {
 	var err error
-	config = NewConfig()
+	c := NewConfig()
 	if *printDefaultConfig {
-		config.Save(os.Stdout)
+		c.Save(os.Stdout)
 		return nil
 	}
 
-	if err = config.LoadFile(*configPath); err != nil {
+	if err = c.LoadFile(*configPath); err != nil {
 		return fmt.Errorf("failed to load config: %s", err)
 	}
-	store = &storage{path: config.Storage.Path}
+	setConfig(c)
+
+	if *testFilters {
+		return runTestFilters()
+	}
+
+	if store, err = newStorage(c.Storage.Path); err != nil {
+		return fmt.Errorf("failed to open storage: %s", err)
+	}
+
+	if *daemonMode {
+		return runDaemon()
+	}
 
 	emailerWG := sync.WaitGroup{}
 	itemChan := make(chan feedItem, 1000)
-	emailerWG.Add(config.SMTP.Jobs)
-	for i := 0; i < config.SMTP.Jobs; i++ {
-		go sendEmails(itemChan, emailerWG.Done)
+	if c.IMAP.Address != "" {
+		emailerWG.Add(c.IMAP.Jobs)
+		for i := 0; i < c.IMAP.Jobs; i++ {
+			go imapDeliver(itemChan, emailerWG.Done)
+		}
+	} else {
+		emailerWG.Add(c.SMTP.Jobs)
+		for i := 0; i < c.SMTP.Jobs; i++ {
+			go sendEmails(itemChan, emailerWG.Done)
+		}
 	}
 
 	procWG := sync.WaitGroup{}
 
 	execFeedCh := make(chan *FeedSpec, 1000)
-	procWG.Add(config.Exec.Jobs)
-	for i := 0; i < config.Exec.Jobs; i++ {
+	procWG.Add(c.Exec.Jobs)
+	for i := 0; i < c.Exec.Jobs; i++ {
 		go processExecFeeds(execFeedCh, itemChan, procWG.Done)
 	}
 
 	domains := map[string]chan *FeedSpec{}
 
-	for _, f := range config.Feeds {
+	for _, f := range c.Feeds {
 		u, err := url.Parse(f.URL)
 		if err != nil {
 			log.Printf("warn: cannot parse '%s' feed URL '%s': %s", f.Name, f.URL, err)
@@ -473,6 +741,12 @@ func run() error {
 	close(itemChan)
 	emailerWG.Wait()
 
+	if c.Digest.Schedule != "" {
+		if err := deliverDueDigest(); err != nil {
+			log.Printf("warn: failed to deliver digest: %s", err)
+		}
+	}
+
 	return nil
 }
 
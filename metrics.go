@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// feedCounters is the set of --daemon counters/gauges tracked per feed and
+// exposed on /metrics, so an operator can monitor a long-running frider the
+// same way they'd monitor any other service.
+type feedCounters struct {
+	fetches    int64
+	failures   int64
+	lastFetch  time.Time
+	emailsSent int64
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   = map[string]*feedCounters{}
+)
+
+func feedCountersFor(name string) *feedCounters {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	fc, ok := metrics[name]
+	if !ok {
+		fc = &feedCounters{}
+		metrics[name] = fc
+	}
+	return fc
+}
+
+// recordFetch records the outcome of one fetch attempt of feed name, url or
+// exec, success or failure alike.
+func recordFetch(name string, ok bool) {
+	fc := feedCountersFor(name)
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	fc.fetches++
+	if !ok {
+		fc.failures++
+	}
+	fc.lastFetch = time.Now()
+}
+
+// recordEmailSent records one successful delivery (SMTP or IMAP) of an item
+// from feed name.
+func recordEmailSent(name string) {
+	fc := feedCountersFor(name)
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	fc.emailsSent++
+}
+
+// metricsHandler serves per-feed counters in the Prometheus text exposition
+// format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	fmt.Fprintln(w, "# HELP frider_feed_fetches_total Number of times a feed was fetched.")
+	fmt.Fprintln(w, "# TYPE frider_feed_fetches_total counter")
+	for name, fc := range metrics {
+		fmt.Fprintf(w, "frider_feed_fetches_total{feed=%q} %d\n", name, fc.fetches)
+	}
+
+	fmt.Fprintln(w, "# HELP frider_feed_failures_total Number of failed fetch attempts for a feed.")
+	fmt.Fprintln(w, "# TYPE frider_feed_failures_total counter")
+	for name, fc := range metrics {
+		fmt.Fprintf(w, "frider_feed_failures_total{feed=%q} %d\n", name, fc.failures)
+	}
+
+	fmt.Fprintln(w, "# HELP frider_feed_last_fetch_timestamp_seconds Unix timestamp of the last fetch attempt.")
+	fmt.Fprintln(w, "# TYPE frider_feed_last_fetch_timestamp_seconds gauge")
+	for name, fc := range metrics {
+		fmt.Fprintf(w, "frider_feed_last_fetch_timestamp_seconds{feed=%q} %d\n", name, fc.lastFetch.Unix())
+	}
+
+	fmt.Fprintln(w, "# HELP frider_feed_emails_sent_total Number of items delivered (by SMTP or IMAP) for a feed.")
+	fmt.Fprintln(w, "# TYPE frider_feed_emails_sent_total counter")
+	for name, fc := range metrics {
+		fmt.Fprintf(w, "frider_feed_emails_sent_total{feed=%q} %d\n", name, fc.emailsSent)
+	}
+}
+
+// startMetricsServer serves /metrics on addr for the life of the daemon.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("warn: metrics server on '%s' stopped: %s", addr, err)
+		}
+	}()
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// defaultMaxImageSize caps inline images/enclosures when a feed doesn't set
+// its own max_image_size.
+const defaultMaxImageSize = 5 * 1024 * 1024
+
+// domainLastFetch/domainThrottleMu enforce sameDomainRequestDelay between
+// ad-hoc fetches (inline images, enclosures) to the same host, mirroring the
+// politeness the per-domain feed channels already give feed fetches
+// themselves, without needing a channel of their own.
+var (
+	domainThrottleMu sync.Mutex
+	domainLastFetch  = map[string]time.Time{}
+)
+
+func throttleDomain(host string) {
+	domainThrottleMu.Lock()
+	wait := time.Duration(0)
+	if last, ok := domainLastFetch[host]; ok {
+		if d := sameDomainRequestDelay - time.Since(last); d > 0 {
+			wait = d
+		}
+	}
+	domainLastFetch[host] = time.Now().Add(wait)
+	domainThrottleMu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// inlinePart is a fetched image or enclosure ready to become a MIME part.
+type inlinePart struct {
+	cid         string
+	contentType string
+	data        []byte
+}
+
+// sanitizeHeaderValue strips CR/LF from s before it's used as (part of) a
+// MIME header value. mime/multipart.Writer.CreatePart doesn't escape header
+// values, so a raw CRLF from feed-controlled data (an enclosure's type/url
+// attributes) would otherwise break out of the header and inject arbitrary
+// additional headers into the generated MIME part.
+func sanitizeHeaderValue(s string) string {
+	return newlinePat.ReplaceAllString(s, " ")
+}
+
+// quoteEscape escapes s for use inside a MIME quoted-string (e.g. a
+// Content-Disposition filename), per RFC 2045 section 5.1.
+func quoteEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, `"`, `\"`)
+}
+
+// fetchURL retrieves rawURL's body, respecting the per-domain request delay
+// and a maximum size, returning its content and Content-Type header.
+func fetchURL(rawURL string, maxSize int64) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot parse url '%s': %s", rawURL, err)
+	}
+	throttleDomain(u.Host)
+
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", useragent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, "", fmt.Errorf("exceeds max size of %d bytes", maxSize)
+	}
+	ct := resp.Header.Get("Content-Type")
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	return data, ct, nil
+}
+
+// embedImages fetches every <img src="..."> in html, deduplicated by
+// content hash, and rewrites the src to a cid: reference. It returns the
+// rewritten HTML and the fetched images to attach inline.
+func embedImages(html string, maxSize int64) (string, []inlinePart, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		return html, nil, fmt.Errorf("cannot parse html for image embedding: %s", err)
+	}
+
+	byHash := map[string]string{} // content hash -> cid
+	var images []inlinePart
+
+	doc.Find("img[src]").Each(func(_ int, sel *goquery.Selection) {
+		src, _ := sel.Attr("src")
+		if src == "" || strings.HasPrefix(src, "cid:") {
+			return
+		}
+		data, ct, err := fetchURL(src, maxSize)
+		if err != nil {
+			log.Printf("warn: failed to embed image '%s': %s", src, err)
+			return
+		}
+		h := fmt.Sprintf("%x", sha256.Sum256(data))
+		cid, ok := byHash[h]
+		if !ok {
+			cid = h + "@frider"
+			byHash[h] = cid
+			images = append(images, inlinePart{cid: cid, contentType: ct, data: data})
+		}
+		sel.SetAttr("src", "cid:"+cid)
+	})
+
+	out, err := doc.Find("body").Html()
+	if err != nil {
+		return html, nil, fmt.Errorf("cannot render html after image embedding: %s", err)
+	}
+	return out, images, nil
+}
+
+// mimePart is one part of a multipart MIME body.
+type mimePart struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// writeMultipart assembles parts into a multipart/<subtype> body and
+// returns it along with its Content-Type header value, boundary included.
+func writeMultipart(subtype string, parts []mimePart) ([]byte, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		pw, err := w.CreatePart(p.header)
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot create multipart/%s part: %s", subtype, err)
+		}
+		if _, err := pw.Write(p.body); err != nil {
+			return nil, "", fmt.Errorf("cannot write multipart/%s part: %s", subtype, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", fmt.Errorf("cannot close multipart/%s body: %s", subtype, err)
+	}
+	return buf.Bytes(), fmt.Sprintf("multipart/%s; boundary=%s", subtype, w.Boundary()), nil
+}
+
+// base64LineLength is the maximum line length for base64-encoded MIME part
+// bodies per RFC 2045 section 6.8.
+const base64LineLength = 76
+
+// base64Wrap base64-encodes data and wraps it at base64LineLength characters
+// per line with CRLF line endings, as RFC 2045 requires: unwrapped encoded
+// bodies run afoul of the line-length limits in RFC 5321/5322 and get
+// rejected or mangled by real mail servers.
+func base64Wrap(data []byte) []byte {
+	enc := base64.StdEncoding.EncodeToString(data)
+	var out bytes.Buffer
+	for len(enc) > base64LineLength {
+		out.WriteString(enc[:base64LineLength])
+		out.WriteString("\r\n")
+		enc = enc[base64LineLength:]
+	}
+	out.WriteString(enc)
+	out.WriteString("\r\n")
+	return out.Bytes()
+}
+
+func base64Part(contentType, disposition string, data []byte) mimePart {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", "base64")
+	h.Set("Content-Disposition", disposition)
+	return mimePart{header: h, body: base64Wrap(data)}
+}
+
+// buildRichMessage assembles an RFC822 message whose HTML body is a
+// multipart/related part (inline images rewritten to cid: references) and,
+// when the item has enclosures, wraps that in a multipart/mixed part
+// carrying each enclosure as a regular attachment.
+func buildRichMessage(fi feedItem, sender, to, subject, content, tagHeader string) (string, error) {
+	maxSize := fi.FeedSpec.MaxImageSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxImageSize
+	}
+
+	htmlBody := content
+	var images []inlinePart
+	if fi.FeedSpec.EmbedImages {
+		var err error
+		htmlBody, images, err = embedImages(content, maxSize)
+		if err != nil {
+			log.Printf("warn: %s", err)
+			htmlBody = content
+		}
+	}
+
+	htmlHeader := textproto.MIMEHeader{}
+	htmlHeader.Set("Content-Type", "text/html; charset=utf8")
+	relatedParts := []mimePart{{header: htmlHeader, body: []byte(htmlBody)}}
+	for _, img := range images {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", sanitizeHeaderValue(img.contentType))
+		h.Set("Content-Transfer-Encoding", "base64")
+		h.Set("Content-ID", "<"+img.cid+">")
+		h.Set("Content-Disposition", "inline")
+		relatedParts = append(relatedParts, mimePart{header: h, body: base64Wrap(img.data)})
+	}
+	body, contentType, err := writeMultipart("related", relatedParts)
+	if err != nil {
+		return "", err
+	}
+
+	var attachments []inlinePart
+	for _, enc := range fi.Item.Enclosures {
+		if enc.URL == "" {
+			continue
+		}
+		data, ct, err := fetchURL(enc.URL, maxSize)
+		if err != nil {
+			log.Printf("warn: failed to fetch enclosure '%s': %s", enc.URL, err)
+			continue
+		}
+		if enc.Type != "" {
+			ct = enc.Type
+		}
+		attachments = append(attachments, inlinePart{cid: sanitizeHeaderValue(path.Base(enc.URL)), contentType: sanitizeHeaderValue(ct), data: data})
+	}
+
+	if len(attachments) > 0 {
+		relatedHeader := textproto.MIMEHeader{}
+		relatedHeader.Set("Content-Type", contentType)
+		mixedParts := []mimePart{{header: relatedHeader, body: body}}
+		for _, a := range attachments {
+			disposition := fmt.Sprintf(`attachment; filename="%s"`, quoteEscape(a.cid))
+			mixedParts = append(mixedParts, base64Part(a.contentType, disposition, a.data))
+		}
+		body, contentType, err = writeMultipart("mixed", mixedParts)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\n%sMIME-Version: 1.0\r\nContent-Type: %s\r\n\r\n",
+		sender, to, subject, tagHeader, contentType)
+	msg.Write(body)
+	return msg.String(), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// fullContentMinLen is the rough length below which a feed's own
+// Content/Description is treated as a stub worth replacing with the full
+// article, rather than an attempt at precisely detecting truncation.
+const fullContentMinLen = 500
+
+// defaultMaxContentSize caps the downloaded size of a full article page when
+// a feed doesn't set its own max_content_size.
+const defaultMaxContentSize = 20 * 1024 * 1024
+
+func needsFullContent(i *richItem) bool {
+	c := i.Content
+	if c == "" {
+		c = i.Description
+	}
+	return len(c) < fullContentMinLen
+}
+
+// fetchFullContent fetches fi.Item.Link and runs the readability extractor
+// over it, populating fi.Item.FullContent for feeds with
+// fetch_full_content set. Results are cached in storage by item URL so a
+// link is only ever fetched/extracted once.
+func fetchFullContent(fi feedItem) {
+	if fi.Item.Link == "" || !needsFullContent(fi.Item) {
+		return
+	}
+
+	if cached, ok := store.extraction(fi.Item.Link); ok {
+		fi.Item.FullContent = cached
+		return
+	}
+
+	maxSize := fi.FeedSpec.MaxContentSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxContentSize
+	}
+	data, _, err := fetchURL(fi.Item.Link, maxSize)
+	if err != nil {
+		log.Printf("warn: failed to fetch full content for '%s': %s", fi.Item.Link, err)
+		return
+	}
+
+	extracted, err := extractReadableContent(string(data), fi.FeedSpec)
+	if err != nil {
+		log.Printf("warn: failed to extract full content for '%s': %s", fi.Item.Link, err)
+		return
+	}
+
+	fi.Item.FullContent = extracted
+	if err := store.setExtraction(fi.Item.Link, extracted); err != nil {
+		log.Printf("warn: failed to cache extraction for '%s': %s", fi.Item.Link, err)
+	}
+}
+
+// extractReadableContent pulls the main article HTML out of a full page,
+// preferring the feed's own content_selector/strip_selectors when set and
+// falling back to a generic "largest block of text" heuristic otherwise.
+func extractReadableContent(html string, fs *FeedSpec) (string, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		return "", fmt.Errorf("cannot parse html: %s", err)
+	}
+
+	for _, sel := range fs.StripSelectors {
+		doc.Find(sel).Remove()
+	}
+
+	var content *goquery.Selection
+	if fs.ContentSelector != "" {
+		if sel := doc.Find(fs.ContentSelector).First(); sel.Length() > 0 {
+			content = sel
+		}
+	}
+	if content == nil {
+		content = largestTextBlock(doc)
+	}
+	if content == nil {
+		return "", fmt.Errorf("no content found")
+	}
+
+	out, err := content.Html()
+	if err != nil {
+		return "", fmt.Errorf("cannot render extracted content: %s", err)
+	}
+	return out, nil
+}
+
+// largestTextBlock is a minimal readability heuristic: the article/main/
+// div/section with the most visible text wins. It's a fallback for sites
+// without a configured content_selector, not a full Readability port.
+func largestTextBlock(doc *goquery.Document) *goquery.Selection {
+	var best *goquery.Selection
+	bestLen := 0
+	doc.Find("article, main, div, section").Each(func(_ int, sel *goquery.Selection) {
+		if l := len(strings.TrimSpace(sel.Text())); l > bestLen {
+			bestLen = l
+			best = sel
+		}
+	})
+	return best
+}
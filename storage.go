@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// storageIndexFile is the name of the on-disk index inside storage.path.
+const storageIndexFile = "index.json"
+
+const (
+	backoffBase = time.Minute
+	backoffMax  = 24 * time.Hour
+)
+
+// feedState is everything storage remembers about a single feed between
+// runs: HTTP caching headers and failure backoff for the fetch itself, plus
+// a per-item content hash used to detect edited items.
+type feedState struct {
+	LastFetched  time.Time         `json:"last_fetched"`
+	ETag         string            `json:"etag,omitempty"`
+	LastModified string            `json:"last_modified,omitempty"`
+	Failures     int               `json:"failures,omitempty"`
+	NextRetry    time.Time         `json:"next_retry,omitempty"`
+	Seen         bool              `json:"seen,omitempty"`
+	Items        map[string]string `json:"items"`
+}
+
+// digestItem is a single feed item buffered for the next digest email. It
+// carries its own rendered content rather than a feedItem, since it must
+// survive a JSON round-trip across process restarts between digest windows.
+type digestItem struct {
+	FeedName string `json:"feed_name"`
+	Title    string `json:"title"`
+	Link     string `json:"link"`
+	Content  string `json:"content"`
+}
+
+// indexFile is the on-disk shape of the storage index: per-feed state, the
+// content-extraction cache (keyed by item URL rather than feed UID since
+// extraction results don't depend on which feed linked to them), and the
+// pending digest queue.
+type indexFile struct {
+	Feeds          map[string]*feedState `json:"feeds"`
+	Extractions    map[string]string     `json:"extractions,omitempty"`
+	FeedUIDsByURL  map[string]string     `json:"feed_uids_by_url,omitempty"`
+	PendingDigest  []digestItem          `json:"pending_digest,omitempty"`
+	LastDigestSent time.Time             `json:"last_digest_sent,omitempty"`
+}
+
+// storage persists feed and item state as a single JSON index keyed by feed
+// UID, replacing the old flat directory of SHA256-named marker files. It
+// lets processDomainFeeds skip feeds whose backoff hasn't elapsed, send
+// conditional GETs and notice when an item's content has changed since it
+// was last emailed.
+type storage struct {
+	path string
+
+	mu             sync.Mutex
+	feeds          map[string]*feedState
+	extractions    map[string]string
+	feedUIDsByURL  map[string]string
+	pendingDigest  []digestItem
+	lastDigestSent time.Time
+}
+
+func newStorage(path string) (*storage, error) {
+	s := &storage{path: path, feeds: map[string]*feedState{}, extractions: map[string]string{}, feedUIDsByURL: map[string]string{}}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *storage) indexPath() string {
+	return filepath.Join(s.path, storageIndexFile)
+}
+
+func (s *storage) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.indexPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("cannot open storage index '%s': %s", s.indexPath(), err)
+	}
+	defer f.Close()
+	var idx indexFile
+	if err := json.NewDecoder(f).Decode(&idx); err != nil {
+		return fmt.Errorf("cannot decode storage index '%s': %s", s.indexPath(), err)
+	}
+	if idx.Feeds != nil {
+		s.feeds = idx.Feeds
+	}
+	if idx.Extractions != nil {
+		s.extractions = idx.Extractions
+	}
+	if idx.FeedUIDsByURL != nil {
+		s.feedUIDsByURL = idx.FeedUIDsByURL
+	}
+	s.pendingDigest = idx.PendingDigest
+	s.lastDigestSent = idx.LastDigestSent
+	return nil
+}
+
+// saveLocked atomically rewrites the index file via a temp file + rename so
+// a crash mid-write can't corrupt it. Caller must hold s.mu.
+func (s *storage) saveLocked() error {
+	tmp, err := os.CreateTemp(s.path, ".index-*.json.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot create temp storage index: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	enc := json.NewEncoder(tmp)
+	enc.SetIndent("", "  ")
+	idx := indexFile{
+		Feeds:          s.feeds,
+		Extractions:    s.extractions,
+		FeedUIDsByURL:  s.feedUIDsByURL,
+		PendingDigest:  s.pendingDigest,
+		LastDigestSent: s.lastDigestSent,
+	}
+	if err := enc.Encode(idx); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot encode storage index: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot close temp storage index: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), s.indexPath()); err != nil {
+		return fmt.Errorf("cannot replace storage index '%s': %s", s.indexPath(), err)
+	}
+	return nil
+}
+
+func (s *storage) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveLocked()
+}
+
+func (s *storage) feedLocked(uid string) *feedState {
+	fst, ok := s.feeds[uid]
+	if !ok {
+		fst = &feedState{}
+		s.feeds[uid] = fst
+	}
+	if fst.Items == nil {
+		fst.Items = map[string]string{}
+	}
+	return fst
+}
+
+// extraction returns the cached full-content extraction for item URL, if any.
+func (s *storage) extraction(itemURL string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	html, ok := s.extractions[itemURL]
+	return html, ok
+}
+
+// setExtraction caches the full-content extraction result for item URL.
+func (s *storage) setExtraction(itemURL, html string) error {
+	s.mu.Lock()
+	s.extractions[itemURL] = html
+	s.mu.Unlock()
+	return s.save()
+}
+
+// feedUIDForURL returns the feed UID processFeeds last computed for a feed
+// fetched from url, so fetchUID can key pre-parse HTTP cache/backoff state
+// the same way the post-parse item state is keyed. It returns url itself if
+// the feed has never been parsed yet.
+func (s *storage) feedUIDForURL(url string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if uid, ok := s.feedUIDsByURL[url]; ok {
+		return uid
+	}
+	return url
+}
+
+// setFeedUIDForURL records the feed UID processFeeds computed for a feed
+// fetched from url, for feedUIDForURL to pick up on the next run.
+func (s *storage) setFeedUIDForURL(url, uid string) error {
+	s.mu.Lock()
+	if s.feedUIDsByURL[url] == uid {
+		s.mu.Unlock()
+		return nil
+	}
+	s.feedUIDsByURL[url] = uid
+	s.mu.Unlock()
+	return s.save()
+}
+
+// dueForFetch reports whether feed uid's exponential backoff window (if any)
+// has elapsed.
+func (s *storage) dueForFetch(uid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fst := s.feedLocked(uid)
+	return fst.Failures == 0 || !time.Now().Before(fst.NextRetry)
+}
+
+// cachingHeaders returns the ETag/Last-Modified values recorded for feed uid
+// on its last successful fetch, for use in a conditional GET.
+func (s *storage) cachingHeaders(uid string) (etag, lastModified string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fst := s.feedLocked(uid)
+	return fst.ETag, fst.LastModified
+}
+
+// recordSuccess clears any failure backoff and stores the caching headers
+// returned by the most recent fetch.
+func (s *storage) recordSuccess(uid, etag, lastModified string) error {
+	s.mu.Lock()
+	fst := s.feedLocked(uid)
+	fst.LastFetched = time.Now()
+	fst.ETag = etag
+	fst.LastModified = lastModified
+	fst.Failures = 0
+	fst.NextRetry = time.Time{}
+	s.mu.Unlock()
+	return s.save()
+}
+
+// recordFailure bumps the failure count and schedules the next retry with
+// exponential backoff, capped at backoffMax.
+func (s *storage) recordFailure(uid string) error {
+	s.mu.Lock()
+	fst := s.feedLocked(uid)
+	fst.Failures++
+	d := time.Duration(math.Pow(2, float64(fst.Failures-1))) * backoffBase
+	if d > backoffMax {
+		d = backoffMax
+	}
+	fst.NextRetry = time.Now().Add(d)
+	s.mu.Unlock()
+	return s.save()
+}
+
+// feedSeen reports whether feed uid has been processed at least once before,
+// i.e. whether new items should be emailed or just recorded as a baseline.
+func (s *storage) feedSeen(uid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.feedLocked(uid).Seen
+}
+
+// markFeedSeen records that feed uid's initial baseline of items has been
+// stored, so subsequent runs email new/updated items instead of just
+// recording them.
+func (s *storage) markFeedSeen(uid string) error {
+	s.mu.Lock()
+	s.feedLocked(uid).Seen = true
+	s.mu.Unlock()
+	return s.save()
+}
+
+// itemHash returns the content hash feed feedUID's item itemUID was last
+// seen with, if any.
+func (s *storage) itemHash(feedUID, itemUID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fst := s.feedLocked(feedUID)
+	h, ok := fst.Items[itemUID]
+	return h, ok
+}
+
+// setItemHash records the content hash an item was last seen/emailed with.
+func (s *storage) setItemHash(feedUID, itemUID, hash string) error {
+	s.mu.Lock()
+	fst := s.feedLocked(feedUID)
+	fst.Items[itemUID] = hash
+	s.mu.Unlock()
+	return s.save()
+}
+
+// addDigestItem appends an item to the pending digest queue so it survives
+// a restart between digest windows.
+func (s *storage) addDigestItem(i digestItem) error {
+	s.mu.Lock()
+	s.pendingDigest = append(s.pendingDigest, i)
+	s.mu.Unlock()
+	return s.save()
+}
+
+// pendingDigestItems returns a snapshot of the pending digest queue without
+// clearing it, so the caller can attempt delivery before committing to
+// having sent it.
+func (s *storage) pendingDigestItems() []digestItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := make([]digestItem, len(s.pendingDigest))
+	copy(items, s.pendingDigest)
+	return items
+}
+
+// drainDigest clears the pending digest queue, once its items have actually
+// been delivered.
+func (s *storage) drainDigest() error {
+	s.mu.Lock()
+	s.pendingDigest = nil
+	s.mu.Unlock()
+	return s.save()
+}
+
+// lastDigestSent returns when the last digest email was sent, the zero time
+// if none has been sent yet.
+func (s *storage) lastDigestSentAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastDigestSent
+}
+
+// setLastDigestSent records when the most recent digest email was sent.
+func (s *storage) setLastDigestSent(t time.Time) error {
+	s.mu.Lock()
+	s.lastDigestSent = t
+	s.mu.Unlock()
+	return s.save()
+}
+
+// hashContent returns a short content hash used to detect edited items.
+func hashContent(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}